@@ -15,28 +15,134 @@
 package client
 
 import (
-	"io/ioutil"
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"log"
 	"os"
-	"path"
-	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/hugelgupf/p9/p9"
 	"golang.org/x/sys/unix"
 )
 
+// rcFile is a reference-counted O_PATH fd. A node's self fd is also held by
+// its zero-name Walk clone, its XattrWalk clone, and by every child walked
+// into it (as that child's parent fd), so the underlying fd can only be
+// closed once every one of those has released its reference. root is
+// exempt: it belongs to the Attacher, is shared by every attached session,
+// and close is a no-op for it.
+type rcFile struct {
+	file *os.File
+	root bool
+	refs int32
+}
+
+// newRCFile wraps a freshly opened fd with a single reference.
+func newRCFile(f *os.File) *rcFile {
+	return &rcFile{file: f, refs: 1}
+}
+
+// ref records an additional holder of r and returns r, for use at the call
+// site that hands out the extra reference.
+func (r *rcFile) ref() *rcFile {
+	atomic.AddInt32(&r.refs, 1)
+	return r
+}
+
+func (r *rcFile) Fd() uintptr {
+	return r.file.Fd()
+}
+
+func (r *rcFile) Stat() (os.FileInfo, error) {
+	return r.file.Stat()
+}
+
+// close releases this holder's reference, closing the underlying fd once
+// the last reference is gone. It is a no-op for a nil receiver (no fd was
+// ever held) and for root.
+func (r *rcFile) close() error {
+	if r == nil || r.root {
+		return nil
+	}
+	if atomic.AddInt32(&r.refs, -1) > 0 {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// refOrNil is ref, except it tolerates and propagates a nil r, for parent
+// fields, which are nil at the attach point.
+func refOrNil(r *rcFile) *rcFile {
+	if r == nil {
+		return nil
+	}
+	return r.ref()
+}
+
 // cpu9p is a p9.Attacher.
+//
+// A cpu9p value is either the attach point, in which case root is the
+// O_PATH|O_DIRECTORY fd of the exported subtree and self == root, or a node
+// reached by walking from the attach point, in which case parent and name
+// locate it within its parent directory and self is an O_PATH fd opened on
+// it with O_NOFOLLOW. Every *at syscall below is issued against self or
+// parent, never against a path built from client-supplied names, so a
+// client can never walk, rename, or link its way outside of root, even via
+// ".." components or an absolute symlink.
 type cpu9p struct {
 	p9.DefaultWalkGetAttr
 
-	path string
+	// root is the fd of the exported subtree, opened once by Attach.
+	root *rcFile
+
+	// parent is a reference to the O_DIRECTORY fd of the directory
+	// containing this node (the parent's self). It is nil only for the
+	// attach point, which has no parent inside the jail.
+	parent *rcFile
+
+	// name is this node's name within parent. It is empty only for the
+	// attach point.
+	name string
+
+	// self is an O_PATH fd opened (with O_NOFOLLOW) on this node itself.
+	// Children are walked relative to it, so it also serves as the dirfd
+	// for any *at syscall addressing this node's contents. It may be
+	// shared (ref-counted) with clones of this node and with children
+	// holding it as their parent.
+	self *rcFile
+
+	// file is set once Open has been called; it is a regular (non
+	// O_PATH) fd used for the actual I/O.
 	file *os.File
 
+	// uidMap and gidMap translate between the ids a remote client uses and
+	// the ids this process creates files as and chowns them to. They are
+	// set once at Attach and shared, unmodified, by every node descended
+	// from it. A nil map is the identity map.
+	uidMap *IDMap
+	gidMap *IDMap
+
 	// pendingXattr is the xattr-related operations that are going to be done
 	// in a tread or twrite request.
 	pendingXattr pendingXattr
+
+	// ctl is true for the synthetic .cpuctl control file (see copy.go). A
+	// ctl node has no self fd and no backing directory entry; Open, ReadAt,
+	// WriteAt, info, and GetAttr special-case it before touching self.
+	ctl bool
+
+	// ctlResult holds the reply to the last write to a ctl node, returned
+	// by the ReadAt that follows it. Only meaningful when ctl is true.
+	// ctlMu guards it: p9.File's ReadAt and WriteAt are documented as only
+	// a "read" concurrency guarantee, so the server is free to call them
+	// concurrently on the same fid, and a copy request is worth more than
+	// the bytes of a torn read to get wrong.
+	ctlResult []byte
+	ctlMu     sync.Mutex
 }
 
 // xattrOp is the xattr related operations, walk or create.
@@ -64,9 +170,28 @@ type pendingXattr struct {
 	flags uint32
 }
 
+// NewAttacher returns a p9.Attacher that exports root. root is opened once,
+// as an O_PATH|O_DIRECTORY fd, and kept open for the lifetime of the
+// returned Attacher; every file reached by walking from it is resolved
+// relative to that fd (or to an fd descending from it) rather than by
+// string path, so the export is a hard jail: no client-supplied name can
+// ever cause a syscall to touch anything outside root.
+//
+// uidMap and gidMap translate uids and gids between the remote client and
+// this host for every file created or stat'd under root; either may be nil
+// to leave that axis unmapped.
+func NewAttacher(root string, uidMap, gidMap *IDMap) (p9.Attacher, error) {
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := &rcFile{file: os.NewFile(uintptr(fd), root), root: true}
+	return &cpu9p{root: f, self: f, uidMap: uidMap, gidMap: gidMap}, nil
+}
+
 // Attach implements p9.Attacher.Attach.
 func (l *cpu9p) Attach() (p9.File, error) {
-	return &cpu9p{path: l.path}, nil
+	return &cpu9p{root: l.root, self: l.root, uidMap: l.uidMap, gidMap: l.gidMap}, nil
 }
 
 var (
@@ -74,6 +199,28 @@ var (
 	_ p9.Attacher = &cpu9p{}
 )
 
+// checkName rejects any name that is not a single, real path component, so
+// that it is always safe to hand to an *at syscall as the final component.
+func checkName(name string) error {
+	switch name {
+	case "", ".", "..":
+		return unix.EINVAL
+	}
+	if strings.ContainsRune(name, '/') {
+		return unix.EINVAL
+	}
+	return nil
+}
+
+// procPath returns a magic /proc/self/fd path for l.self. Some operations
+// (re-opening with real flags, xattrs, reading a symlink's target) have no
+// *at equivalent that takes an already-open O_PATH fd directly; going via
+// /proc/self/fd keeps them pinned to the exact node l.self refers to,
+// without ever re-resolving a client-supplied name.
+func (l *cpu9p) procPath() string {
+	return fmt.Sprintf("/proc/self/fd/%d", l.self.Fd())
+}
+
 // info constructs a QID for this file.
 func (l *cpu9p) info() (p9.QID, os.FileInfo, error) {
 	var (
@@ -83,10 +230,18 @@ func (l *cpu9p) info() (p9.QID, os.FileInfo, error) {
 	)
 
 	// Stat the file.
-	if l.file != nil {
+	switch {
+	case l.ctl:
+		l.ctlMu.Lock()
+		size := len(l.ctlResult)
+		l.ctlMu.Unlock()
+		return p9.QID{Type: p9.TypeRegular, Path: ctlQIDPath}, ctlFileInfo{size: size}, nil
+	case l.file != nil:
 		fi, err = l.file.Stat()
-	} else {
-		fi, err = os.Lstat(l.path)
+	case l.self != nil:
+		fi, err = l.self.Stat()
+	default:
+		return qid, nil, os.ErrInvalid
 	}
 	if err != nil {
 		//log.Printf("error stating %#v: %v", l, err)
@@ -102,16 +257,24 @@ func (l *cpu9p) info() (p9.QID, os.FileInfo, error) {
 }
 
 func (l *cpu9p) XattrWalk(attr string) (p9.File, uint64, error) {
+	if l.ctl {
+		return nil, 0, unix.EINVAL
+	}
 	emptyBuf := make([]byte, 0)
 	var size int
 	var err error
 	if attr == "" {
-		size, err = unix.Llistxattr(l.path, emptyBuf)
+		size, err = unix.Llistxattr(l.procPath(), emptyBuf)
 	} else {
-		size, err = unix.Lgetxattr(l.path, attr, emptyBuf)
+		size, err = unix.Lgetxattr(l.procPath(), attr, emptyBuf)
 	}
 	newFile := &cpu9p{
-		path: l.path,
+		root:   l.root,
+		parent: refOrNil(l.parent),
+		name:   l.name,
+		self:   l.self.ref(),
+		uidMap: l.uidMap,
+		gidMap: l.gidMap,
 		pendingXattr: pendingXattr{
 			op:   xattrWalk,
 			name: attr,
@@ -129,28 +292,64 @@ func (l *cpu9p) XattrCreate(attr string, size uint64, flags uint32) error {
 	return nil
 }
 
+// walkOne opens name relative to l, which must be a directory, and returns
+// the resulting node. name is validated first, and the open uses O_NOFOLLOW,
+// so the result can never be outside of l.
+func (l *cpu9p) walkOne(name string) (*cpu9p, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	if l.ctl {
+		// The control file isn't a directory; nothing walks past it.
+		return nil, unix.ENOTDIR
+	}
+	if l.parent == nil && name == cpuctlName {
+		return l.newCtlNode(), nil
+	}
+	fd, err := unix.Openat(int(l.self.Fd()), name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &cpu9p{
+		root:   l.root,
+		parent: l.self.ref(),
+		name:   name,
+		self:   newRCFile(os.NewFile(uintptr(fd), name)),
+		uidMap: l.uidMap,
+		gidMap: l.gidMap,
+	}, nil
+}
+
 // Walk implements p9.File.Walk.
 func (l *cpu9p) Walk(names []string) ([]p9.QID, p9.File, error) {
 	var qids []p9.QID
-	last := &cpu9p{path: l.path}
 	// If the names are empty we return info for l
 	// An extra stat is never hurtful; all servers
 	// are a bundle of race conditions and there's no need
 	// to make things worse.
 	if len(names) == 0 {
-		c := &cpu9p{path: last.path}
+		var c *cpu9p
+		if l.ctl {
+			c = &cpu9p{root: l.root, parent: refOrNil(l.parent), name: l.name, ctl: true, uidMap: l.uidMap, gidMap: l.gidMap}
+		} else {
+			c = &cpu9p{root: l.root, parent: refOrNil(l.parent), name: l.name, self: l.self.ref(), uidMap: l.uidMap, gidMap: l.gidMap}
+		}
 		qid, fi, err := c.info()
 		verbose("Walk to %v: %v, %v, %v", *c, qid, fi, err)
 		if err != nil {
 			return nil, nil, err
 		}
 		qids = append(qids, qid)
-		verbose("Walk: return %v, %v, nil", qids, last)
-		return qids, last, nil
+		verbose("Walk: return %v, %v, nil", qids, c)
+		return qids, c, nil
 	}
 	verbose("Walk: %v", names)
+	last := l
 	for _, name := range names {
-		c := &cpu9p{path: filepath.Join(last.path, name)}
+		c, err := last.walkOne(name)
+		if err != nil {
+			return nil, nil, err
+		}
 		qid, fi, err := c.info()
 		verbose("Walk to %v: %v, %v, %v", *c, qid, fi, err)
 		if err != nil {
@@ -170,10 +369,24 @@ func (l *cpu9p) FSync() error {
 
 // Close implements p9.File.Close.
 func (l *cpu9p) Close() error {
+	// Every fid a client walks to gets exactly one Close, so this is where
+	// this node's references to self and parent are released; self's (and
+	// parent's) underlying fd only actually closes once every other
+	// holder -- clones from a zero-name Walk or XattrWalk, and any child
+	// walked into it -- has released its own reference too.
+	var err error
 	if l.file != nil {
-		return l.file.Close()
+		if ferr := l.file.Close(); ferr != nil {
+			err = ferr
+		}
 	}
-	return nil
+	if serr := l.self.close(); err == nil {
+		err = serr
+	}
+	if perr := l.parent.close(); err == nil {
+		err = perr
+	}
+	return err
 }
 
 // Open implements p9.File.Open.
@@ -183,11 +396,19 @@ func (l *cpu9p) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
 	if err != nil {
 		return qid, 0, err
 	}
+	if l.ctl {
+		l.ctlMu.Lock()
+		l.ctlResult = nil
+		l.ctlMu.Unlock()
+		return qid, 0, nil
+	}
 
 	flags := osflags(fi, mode)
-	// Do the actual open.
-	f, err := os.OpenFile(l.path, flags, 0)
-	verbose("Open(%v, %v, %v): (%v, %v", l.path, flags, 0, f, err)
+	// Do the actual open, via the magic /proc/self/fd link for l.self so
+	// that re-opening with real (non O_PATH) flags still can't resolve
+	// anywhere outside of the jail.
+	f, err := os.OpenFile(l.procPath(), flags, 0)
+	verbose("Open(%v, %v, %v): (%v, %v", l.name, flags, 0, f, err)
 	if err != nil {
 		return qid, 0, err
 	}
@@ -200,6 +421,14 @@ func (l *cpu9p) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
 
 // Read implements p9.File.ReadAt.
 func (l *cpu9p) ReadAt(p []byte, offset int64) (int, error) {
+	if l.ctl {
+		l.ctlMu.Lock()
+		defer l.ctlMu.Unlock()
+		if offset < 0 || offset >= int64(len(l.ctlResult)) {
+			return 0, nil
+		}
+		return copy(p, l.ctlResult[offset:]), nil
+	}
 	switch l.pendingXattr.op {
 	case xattrNone:
 		return l.file.ReadAt(p, int64(offset))
@@ -211,9 +440,9 @@ func (l *cpu9p) ReadAt(p []byte, offset int64) (int, error) {
 			return 0, syscall.EINVAL
 		}
 		if l.pendingXattr.name == "" {
-			return unix.Llistxattr(l.path, p)
+			return unix.Llistxattr(l.procPath(), p)
 		}
-		return unix.Lgetxattr(l.path, l.pendingXattr.name, p)
+		return unix.Lgetxattr(l.procPath(), l.pendingXattr.name, p)
 	default:
 		return 0, syscall.EINVAL
 	}
@@ -228,6 +457,9 @@ func (l *cpu9p) ReadAt(p []byte, offset int64) (int, error) {
 // error, and call Write if it is the rare case of a second write
 // to an append-only file..
 func (l *cpu9p) WriteAt(p []byte, offset int64) (int, error) {
+	if l.ctl {
+		return l.ctlWrite(p, offset)
+	}
 	switch l.pendingXattr.op {
 	case xattrNone:
 		n, err := l.file.WriteAt(p, int64(offset))
@@ -242,7 +474,7 @@ func (l *cpu9p) WriteAt(p []byte, offset int64) (int, error) {
 			return 0, syscall.EINVAL
 		}
 		flags := int(l.pendingXattr.flags)
-		return int(l.pendingXattr.size), unix.Lsetxattr(l.path, l.pendingXattr.name, p, flags)
+		return int(l.pendingXattr.size), unix.Lsetxattr(l.procPath(), l.pendingXattr.name, p, flags)
 	default:
 		return 0, syscall.EINVAL
 	}
@@ -250,13 +482,33 @@ func (l *cpu9p) WriteAt(p []byte, offset int64) (int, error) {
 }
 
 // Create implements p9.File.Create.
-func (l *cpu9p) Create(name string, mode p9.OpenFlags, permissions p9.FileMode, _ p9.UID, _ p9.GID) (p9.File, p9.QID, uint32, error) {
-	f, err := os.OpenFile(filepath.Join(l.path, name), os.O_CREATE|mode.OSFlags(), os.FileMode(permissions))
+func (l *cpu9p) Create(name string, mode p9.OpenFlags, permissions p9.FileMode, uid p9.UID, gid p9.GID) (p9.File, p9.QID, uint32, error) {
+	if l.ctl {
+		return nil, p9.QID{}, 0, unix.ENOTDIR
+	}
+	if err := checkName(name); err != nil {
+		return nil, p9.QID{}, 0, err
+	}
+	dirfd := int(l.self.Fd())
+	fd, err := unix.Openat(dirfd, name, unix.O_CREAT|unix.O_NOFOLLOW|mode.OSFlags(), uint32(permissions))
 	if err != nil {
 		return nil, p9.QID{}, 0, err
 	}
+	file := os.NewFile(uintptr(fd), name)
 
-	l2 := &cpu9p{path: filepath.Join(l.path, name), file: f}
+	if err := l.chownNew(name, uid, gid); err != nil {
+		file.Close()
+		unix.Unlinkat(dirfd, name, 0)
+		return nil, p9.QID{}, 0, err
+	}
+
+	selfFd, err := unix.Openat(dirfd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		file.Close()
+		return nil, p9.QID{}, 0, err
+	}
+
+	l2 := &cpu9p{root: l.root, parent: l.self.ref(), name: name, self: newRCFile(os.NewFile(uintptr(selfFd), name)), file: file, uidMap: l.uidMap, gidMap: l.gidMap}
 	qid, _, err := l2.info()
 	if err != nil {
 		l2.Close()
@@ -268,56 +520,204 @@ func (l *cpu9p) Create(name string, mode p9.OpenFlags, permissions p9.FileMode,
 	return l2, qid, 0, nil
 }
 
-// Mkdir implements p9.File.Mkdir.
-//
-// Not properly implemented.
-func (l *cpu9p) Mkdir(name string, permissions p9.FileMode, _ p9.UID, _ p9.GID) (p9.QID, error) {
-	if err := os.Mkdir(filepath.Join(l.path, name), os.FileMode(permissions)); err != nil {
+// chownNew maps uid and gid to host ids and chowns name, freshly created as
+// a child of l, to them, so that a file created by a remote user keeps that
+// user's identity instead of silently becoming whoever runs the cpu
+// server.
+func (l *cpu9p) chownNew(name string, uid p9.UID, gid p9.GID) error {
+	hostUID, err := l.uidMap.ToHost(uint32(uid))
+	if err != nil {
+		return err
+	}
+	hostGID, err := l.gidMap.ToHost(uint32(gid))
+	if err != nil {
+		return err
+	}
+	return unix.Fchownat(int(l.self.Fd()), name, int(hostUID), int(hostGID), unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// qidForChild stats name, freshly created as a child of l, and returns its
+// QID, so callers that create an entry can hand the client real inode
+// identity instead of making it Walk back in to discover one.
+func (l *cpu9p) qidForChild(name string) (p9.QID, error) {
+	fd, err := unix.Openat(int(l.self.Fd()), name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return p9.QID{}, err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
 		return p9.QID{}, err
 	}
+	return p9.QID{
+		Type: p9.ModeFromOS(fi.Mode()).QIDType(),
+		Path: fi.Sys().(*syscall.Stat_t).Ino,
+	}, nil
+}
 
-	// Blank QID.
-	return p9.QID{}, nil
+// Mkdir implements p9.File.Mkdir.
+func (l *cpu9p) Mkdir(name string, permissions p9.FileMode, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	if l.ctl {
+		return p9.QID{}, unix.ENOTDIR
+	}
+	if err := checkName(name); err != nil {
+		return p9.QID{}, err
+	}
+	if err := unix.Mkdirat(int(l.self.Fd()), name, uint32(permissions)); err != nil {
+		return p9.QID{}, err
+	}
+	if err := l.chownNew(name, uid, gid); err != nil {
+		unix.Unlinkat(int(l.self.Fd()), name, unix.AT_REMOVEDIR)
+		return p9.QID{}, err
+	}
+	return l.qidForChild(name)
 }
 
 // Symlink implements p9.File.Symlink.
-//
-// Not properly implemented.
-func (l *cpu9p) Symlink(oldname string, newname string, _ p9.UID, _ p9.GID) (p9.QID, error) {
-	if err := os.Symlink(oldname, filepath.Join(l.path, newname)); err != nil {
+func (l *cpu9p) Symlink(oldname string, newname string, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	if l.ctl {
+		return p9.QID{}, unix.ENOTDIR
+	}
+	if err := checkName(newname); err != nil {
 		return p9.QID{}, err
 	}
-
-	// Blank QID.
-	return p9.QID{}, nil
+	if err := unix.Symlinkat(oldname, int(l.self.Fd()), newname); err != nil {
+		return p9.QID{}, err
+	}
+	if err := l.chownNew(newname, uid, gid); err != nil {
+		unix.Unlinkat(int(l.self.Fd()), newname, 0)
+		return p9.QID{}, err
+	}
+	return l.qidForChild(newname)
 }
 
 // Link implements p9.File.Link.
-//
-// Not properly implemented.
 func (l *cpu9p) Link(target p9.File, newname string) error {
-	return os.Link(target.(*cpu9p).path, filepath.Join(l.path, newname))
+	if l.ctl {
+		return unix.ENOTDIR
+	}
+	if err := checkName(newname); err != nil {
+		return err
+	}
+	t, ok := target.(*cpu9p)
+	if !ok {
+		// This is extremely serious and points to an internal error.
+		// Hence the non-optional log.Printf. It should not ever happen.
+		log.Printf("Can not happen: cast of target to %T failed; it is type %T", l, target)
+		return os.ErrInvalid
+	}
+	if t.ctl {
+		return unix.EINVAL
+	}
+	return unix.Linkat(int(t.self.Fd()), "", int(l.self.Fd()), newname, unix.AT_EMPTY_PATH)
+}
+
+// direntTypeMode maps a getdents64 d_type (or the DT_ value that
+// modeFromStatType picks for an S_IFMT stat mode) to the os.FileMode bits
+// p9.ModeFromOS expects, so Readdir can derive a Dirent.Type without
+// stat-ing every entry.
+func direntTypeMode(dtype uint8) os.FileMode {
+	switch dtype {
+	case unix.DT_DIR:
+		return os.ModeDir
+	case unix.DT_LNK:
+		return os.ModeSymlink
+	case unix.DT_FIFO:
+		return os.ModeNamedPipe
+	case unix.DT_SOCK:
+		return os.ModeSocket
+	case unix.DT_CHR:
+		return os.ModeDevice | os.ModeCharDevice
+	case unix.DT_BLK:
+		return os.ModeDevice
+	default:
+		// DT_REG, DT_WHT, and anything else not handled above.
+		return 0
+	}
+}
+
+// modeFromStatType converts a raw stat(2) st_mode to the same os.FileMode
+// bits as direntTypeMode, for the DT_UNKNOWN fallback.
+func modeFromStatType(stMode uint32) os.FileMode {
+	switch stMode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		return direntTypeMode(unix.DT_DIR)
+	case unix.S_IFLNK:
+		return direntTypeMode(unix.DT_LNK)
+	case unix.S_IFIFO:
+		return direntTypeMode(unix.DT_FIFO)
+	case unix.S_IFSOCK:
+		return direntTypeMode(unix.DT_SOCK)
+	case unix.S_IFCHR:
+		return direntTypeMode(unix.DT_CHR)
+	case unix.S_IFBLK:
+		return direntTypeMode(unix.DT_BLK)
+	default:
+		return 0
+	}
 }
 
 // Readdir implements p9.File.Readdir.
+//
+// l.file (opened by Open) is seeked to offset, which is either 0 or a
+// d_off previously returned in a Dirent, and a single getdents64 is issued
+// from there. This keeps a million-entry directory to O(entries read) total
+// across all the chunk-sized Readdir calls a client makes, instead of the
+// O(N^2) re-scan-and-sort-and-stat-everything that re-reading the whole
+// directory on every call would cost. d_type tells us the Dirent.Type for
+// free; lstatat is only needed when the filesystem doesn't report it.
 func (l *cpu9p) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
-	fi, err := ioutil.ReadDir(l.path)
+	if l.file == nil {
+		return nil, os.ErrInvalid
+	}
+	dirfd := int(l.file.Fd())
+	if _, err := unix.Seek(dirfd, int64(offset), unix.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, count)
+	n, err := unix.Getdents(dirfd, buf)
 	if err != nil {
 		return nil, err
 	}
+
 	var dirents p9.Dirents
-	//log.Printf("readdir %q returns %d entries start at offset %d", l.path, len(fi), offset)
-	for i := int(offset); i < len(fi); i++ {
-		entry := cpu9p{path: filepath.Join(l.path, fi[i].Name())}
-		qid, _, err := entry.info()
-		if err != nil {
+	for rec := buf[:n]; len(rec) >= 19; {
+		reclen := binary.LittleEndian.Uint16(rec[16:18])
+		if int(reclen) < 19 || int(reclen) > len(rec) {
+			break
+		}
+		ino := binary.LittleEndian.Uint64(rec[0:8])
+		off := binary.LittleEndian.Uint64(rec[8:16])
+		dtype := rec[18]
+		nameBuf := rec[19:reclen]
+		if i := bytes.IndexByte(nameBuf, 0); i >= 0 {
+			nameBuf = nameBuf[:i]
+		}
+		name := string(nameBuf)
+		rec = rec[reclen:]
+
+		if name == "." || name == ".." {
 			continue
 		}
+
+		mode := direntTypeMode(dtype)
+		if dtype == unix.DT_UNKNOWN {
+			var st unix.Stat_t
+			if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				continue
+			}
+			mode = modeFromStatType(st.Mode)
+			ino = st.Ino
+		}
+
+		qidType := p9.ModeFromOS(mode).QIDType()
 		dirents = append(dirents, p9.Dirent{
-			QID:    qid,
-			Type:   qid.Type,
-			Name:   fi[i].Name(),
-			Offset: uint64(i + 1),
+			QID:    p9.QID{Type: qidType, Path: ino},
+			Type:   qidType,
+			Name:   name,
+			Offset: off,
 		})
 	}
 
@@ -326,7 +726,10 @@ func (l *cpu9p) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
 
 // Readlink implements p9.File.Readlink.
 func (l *cpu9p) Readlink() (string, error) {
-	n, err := os.Readlink(l.path)
+	if l.ctl {
+		return "", unix.EINVAL
+	}
+	n, err := os.Readlink(l.procPath())
 	if false && err != nil {
 		log.Printf("Readlink(%v): %v, %v", *l, n, err)
 	}
@@ -340,13 +743,30 @@ func (l *cpu9p) Flush() error {
 
 // Renamed implements p9.File.Renamed.
 func (l *cpu9p) Renamed(parent p9.File, newName string) {
-	l.path = filepath.Join(parent.(*cpu9p).path, newName)
+	p, ok := parent.(*cpu9p)
+	if !ok {
+		// This is extremely serious and points to an internal error.
+		// Hence the non-optional log.Printf. It should not ever happen.
+		log.Printf("Can not happen: cast of parent to %T failed; it is type %T", l, parent)
+		return
+	}
+	old := l.parent
+	l.parent = p.self.ref()
+	old.close()
+	l.name = newName
 }
 
 // Remove implements p9.File.Remove
 func (l *cpu9p) Remove() error {
-	err := os.Remove(l.path)
-	verbose("Remove(%q): (%v)", l.path, err)
+	if l.parent == nil {
+		return os.ErrInvalid
+	}
+	flags := 0
+	if _, fi, err := l.info(); err == nil && fi.IsDir() {
+		flags = unix.AT_REMOVEDIR
+	}
+	err := unix.Unlinkat(int(l.parent.Fd()), l.name, flags)
+	verbose("Remove(%q): (%v)", l.name, err)
 	return err
 }
 
@@ -354,16 +774,37 @@ func (l *cpu9p) Remove() error {
 // The flags docs are not very clear, but we
 // always block on the unlink anyway.
 func (l *cpu9p) UnlinkAt(name string, flags uint32) error {
-	f := filepath.Join(l.path, name)
-	err := os.Remove(f)
-	verbose("UnlinkAt(%q=(%q, %q), %#x): (%v)", f, l.path, name, flags, err)
+	if l.ctl {
+		return unix.ENOTDIR
+	}
+	if err := checkName(name); err != nil {
+		return err
+	}
+	err := unix.Unlinkat(int(l.self.Fd()), name, int(flags&unix.AT_REMOVEDIR))
+	verbose("UnlinkAt(%q=(%q, %q), %#x): (%v)", name, l.name, name, flags, err)
 	return err
 }
 
 // Mknod implements p9.File.Mknod.
-func (*cpu9p) Mknod(name string, mode p9.FileMode, major uint32, minor uint32, _ p9.UID, _ p9.GID) (p9.QID, error) {
-	verbose("Mknod: not implemented")
-	return p9.QID{}, syscall.ENOSYS
+//
+// mode carries the node's file type in its upper bits, the same encoding
+// Linux mknod(2) expects, so it is passed straight through to Mknodat.
+func (l *cpu9p) Mknod(name string, mode p9.FileMode, major uint32, minor uint32, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	if l.ctl {
+		return p9.QID{}, unix.ENOTDIR
+	}
+	if err := checkName(name); err != nil {
+		return p9.QID{}, err
+	}
+	dev := unix.Mkdev(major, minor)
+	if err := unix.Mknodat(int(l.self.Fd()), name, uint32(mode), int(dev)); err != nil {
+		return p9.QID{}, err
+	}
+	if err := l.chownNew(name, uid, gid); err != nil {
+		unix.Unlinkat(int(l.self.Fd()), name, 0)
+		return p9.QID{}, err
+	}
+	return l.qidForChild(name)
 }
 
 // Rename implements p9.File.Rename.
@@ -373,9 +814,16 @@ func (*cpu9p) Rename(directory p9.File, name string) error {
 }
 
 // RenameAt implements p9.File.RenameAt.
-// There is no guarantee that there is not a zipslip issue.
 func (l *cpu9p) RenameAt(oldName string, newDir p9.File, newName string) error {
-	oldPath := path.Join(l.path, oldName)
+	if l.ctl {
+		return unix.ENOTDIR
+	}
+	if err := checkName(oldName); err != nil {
+		return err
+	}
+	if err := checkName(newName); err != nil {
+		return err
+	}
 	nd, ok := newDir.(*cpu9p)
 	if !ok {
 		// This is extremely serious and points to an internal error.
@@ -383,15 +831,128 @@ func (l *cpu9p) RenameAt(oldName string, newDir p9.File, newName string) error {
 		log.Printf("Can not happen: cast of newDir to %T failed; it is type %T", l, newDir)
 		return os.ErrInvalid
 	}
-	newPath := path.Join(nd.path, newName)
+	if nd.ctl {
+		return unix.ENOTDIR
+	}
 
-	return os.Rename(oldPath, newPath)
+	return unix.Renameat2(int(l.self.Fd()), oldName, int(nd.self.Fd()), newName, 0)
 }
 
 // StatFS implements p9.File.StatFS.
-//
-// Not implemented.
-func (*cpu9p) StatFS() (p9.FSStat, error) {
-	verbose("StatFS: not implemented")
-	return p9.FSStat{}, syscall.ENOSYS
+func (l *cpu9p) StatFS() (p9.FSStat, error) {
+	if l.ctl {
+		return p9.FSStat{}, unix.EINVAL
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(l.self.Fd()), &st); err != nil {
+		return p9.FSStat{}, err
+	}
+	return p9.FSStat{
+		Type:            uint32(st.Type),
+		BlockSize:       uint32(st.Bsize),
+		Blocks:          st.Blocks,
+		BlocksFree:      st.Bfree,
+		BlocksAvailable: st.Bavail,
+		Files:           st.Files,
+		FilesFree:       st.Ffree,
+		NameLength:      uint32(st.Namelen),
+	}, nil
+}
+
+// GetAttr implements p9.File.GetAttr, translating the host st_uid/st_gid
+// back to the ids the client's uidMap/gidMap say they should appear as.
+func (l *cpu9p) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	qid, fi, err := l.info()
+	if err != nil {
+		return p9.QID{}, p9.AttrMask{}, p9.Attr{}, err
+	}
+	if l.ctl {
+		return qid, p9.AttrMask{Mode: true, Size: true}, p9.Attr{
+			Mode: p9.ModeFromOS(fi.Mode()),
+			Size: uint64(fi.Size()),
+		}, nil
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	attr := p9.Attr{
+		Mode:             p9.ModeFromOS(fi.Mode()),
+		UID:              p9.UID(l.uidMap.ToContainer(st.Uid)),
+		GID:              p9.GID(l.gidMap.ToContainer(st.Gid)),
+		NLink:            p9.NLink(st.Nlink),
+		RDev:             p9.Dev(st.Rdev),
+		Size:             uint64(st.Size),
+		BlockSize:        uint64(st.Blksize),
+		Blocks:           uint64(st.Blocks),
+		ATimeSeconds:     uint64(st.Atim.Sec),
+		ATimeNanoSeconds: uint64(st.Atim.Nsec),
+		MTimeSeconds:     uint64(st.Mtim.Sec),
+		MTimeNanoSeconds: uint64(st.Mtim.Nsec),
+		CTimeSeconds:     uint64(st.Ctim.Sec),
+		CTimeNanoSeconds: uint64(st.Ctim.Nsec),
+	}
+	return qid, p9.AttrMask{
+		Mode: true, UID: true, GID: true, NLink: true, RDev: true, Size: true,
+		Blocks: true, ATime: true, MTime: true, CTime: true,
+	}, attr, nil
+}
+
+// SetAttr implements p9.File.SetAttr, mapping the container uid/gid the
+// client asks for to host ids before chowning.
+func (l *cpu9p) SetAttr(valid p9.SetAttrMask, attr p9.SetAttr) error {
+	if l.ctl {
+		return unix.EINVAL
+	}
+	if valid.Permissions {
+		if err := unix.Fchmodat(unix.AT_FDCWD, l.procPath(), uint32(attr.Permissions), 0); err != nil {
+			return err
+		}
+	}
+	if valid.UID || valid.GID {
+		if l.parent == nil {
+			return os.ErrInvalid
+		}
+		hostUID := -1
+		hostGID := -1
+		if valid.UID {
+			h, err := l.uidMap.ToHost(uint32(attr.UID))
+			if err != nil {
+				return err
+			}
+			hostUID = int(h)
+		}
+		if valid.GID {
+			h, err := l.gidMap.ToHost(uint32(attr.GID))
+			if err != nil {
+				return err
+			}
+			hostGID = int(h)
+		}
+		if err := unix.Fchownat(int(l.parent.Fd()), l.name, hostUID, hostGID, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+	if valid.Size {
+		if l.file == nil {
+			return os.ErrInvalid
+		}
+		if err := l.file.Truncate(int64(attr.Size)); err != nil {
+			return err
+		}
+	}
+	if valid.ATime || valid.MTime {
+		// utimensat has no *at-on-O_PATH-fd form that doesn't need a
+		// real path, so go via the magic /proc/self/fd link as above.
+		atime := unix.Timespec{Sec: int64(attr.ATimeSeconds), Nsec: int64(attr.ATimeNanoSeconds)}
+		mtime := unix.Timespec{Sec: int64(attr.MTimeSeconds), Nsec: int64(attr.MTimeNanoSeconds)}
+		if !valid.ATime {
+			atime.Nsec = unix.UTIME_OMIT
+		}
+		if !valid.MTime {
+			mtime.Nsec = unix.UTIME_OMIT
+		}
+		times := [2]unix.Timespec{atime, mtime}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, l.procPath(), times[:], 0); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,88 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// attachRoot exports dir and returns the attach-point p9.File, closing it
+// when the test ends. Closing the attach point leaves the Attacher's root fd
+// open, since rcFile.close is a no-op for root.
+func attachRoot(t *testing.T, dir string) *cpu9p {
+	t.Helper()
+	at, err := NewAttacher(dir, nil, nil)
+	if err != nil {
+		t.Fatalf("NewAttacher(%q): %v", dir, err)
+	}
+	f, err := at.Attach()
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	root := f.(*cpu9p)
+	t.Cleanup(func() { root.Close() })
+	return root
+}
+
+// TestWalkRejectsDotDot verifies that a ".." path component, the classic
+// zipslip escape, is rejected outright rather than being handed to a
+// syscall that might resolve it.
+func TestWalkRejectsDotDot(t *testing.T) {
+	root := attachRoot(t, t.TempDir())
+	if _, _, err := root.Walk([]string{".."}); err == nil {
+		t.Fatal(`Walk([".."]) succeeded, want an error`)
+	}
+}
+
+// TestWalkRejectsMultiComponentName verifies that a single walk name
+// embedding a "/" (e.g. an attempt to smuggle an absolute path or a
+// multi-component escape into one name) is rejected, since every *at
+// syscall below assumes each name is exactly one path component.
+func TestWalkRejectsMultiComponentName(t *testing.T) {
+	root := attachRoot(t, t.TempDir())
+	if _, _, err := root.Walk([]string{"../../etc/passwd"}); err == nil {
+		t.Fatal(`Walk(["../../etc/passwd"]) succeeded, want an error`)
+	}
+}
+
+// TestWalkCannotTraverseSymlinkEscape verifies that a symlink pointing
+// outside root can be walked TO (its own O_PATH fd), but never walked
+// THROUGH: resolving a further component against it must fail instead of
+// silently following the link out of the jail.
+func TestWalkCannotTraverseSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("top secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	l := attachRoot(t, root)
+
+	// Walking to the symlink itself is fine: it's a real entry in root.
+	if _, _, err := l.Walk([]string{"escape"}); err != nil {
+		t.Fatalf("Walk([\"escape\"]): %v", err)
+	}
+
+	// But walking through it to reach what it points to must not succeed.
+	if _, _, err := l.Walk([]string{"escape", "secret"}); err == nil {
+		t.Fatal(`Walk(["escape", "secret"]) escaped the jail via a symlink, want an error`)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import "golang.org/x/sys/unix"
+
+// UnmappedIDPolicy controls what IDMap.ToHost does with an id that falls
+// outside every configured range, mirroring the choices virtiofsd's
+// --uid-map/--gid-map and the kernel's user namespace /etc/subuid mapping
+// offer.
+type UnmappedIDPolicy int
+
+const (
+	// UnmappedIDReject fails the operation with EINVAL.
+	UnmappedIDReject UnmappedIDPolicy = iota
+	// UnmappedIDSquash maps the id to nobody (65534).
+	UnmappedIDSquash
+	// UnmappedIDPassthrough returns the id unchanged.
+	UnmappedIDPassthrough
+)
+
+// nobody is the conventional "nobody"/"nogroup" id used by UnmappedIDSquash.
+const nobody = 65534
+
+// IDRange maps a contiguous run of container-side ids, starting at
+// ContainerID, to the same-length run of host-side ids starting at HostID.
+type IDRange struct {
+	ContainerID uint32
+	HostID      uint32
+	Length      uint32
+}
+
+func (r IDRange) containerToHost(id uint32) (uint32, bool) {
+	if id < r.ContainerID || id-r.ContainerID >= r.Length {
+		return 0, false
+	}
+	return r.HostID + (id - r.ContainerID), true
+}
+
+func (r IDRange) hostToContainer(id uint32) (uint32, bool) {
+	if id < r.HostID || id-r.HostID >= r.Length {
+		return 0, false
+	}
+	return r.ContainerID + (id - r.HostID), true
+}
+
+// IDMap translates uids or gids between the values a remote client uses
+// (container ids) and the values this process uses on disk (host ids), so
+// that files created by different remote users don't all collapse into
+// whoever is running the cpu server. A nil *IDMap is the identity map.
+type IDMap struct {
+	ranges   []IDRange
+	unmapped UnmappedIDPolicy
+}
+
+// NewIDMap builds an IDMap from ranges, applied in the order given, with
+// unmapped controlling ids that fall outside all of them.
+func NewIDMap(ranges []IDRange, unmapped UnmappedIDPolicy) *IDMap {
+	return &IDMap{ranges: ranges, unmapped: unmapped}
+}
+
+// ToHost maps a container id to the host id it should be created or
+// chowned as.
+func (m *IDMap) ToHost(id uint32) (uint32, error) {
+	if m == nil {
+		return id, nil
+	}
+	for _, r := range m.ranges {
+		if host, ok := r.containerToHost(id); ok {
+			return host, nil
+		}
+	}
+	switch m.unmapped {
+	case UnmappedIDSquash:
+		return nobody, nil
+	case UnmappedIDPassthrough:
+		return id, nil
+	default:
+		return 0, unix.EINVAL
+	}
+}
+
+// ToContainer maps a host id, as seen in an st_uid/st_gid, back to the
+// container id it should be reported as.
+func (m *IDMap) ToContainer(id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	for _, r := range m.ranges {
+		if c, ok := r.hostToContainer(id); ok {
+			return c
+		}
+	}
+	if m.unmapped == UnmappedIDSquash {
+		return nobody
+	}
+	return id
+}
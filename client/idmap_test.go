@@ -0,0 +1,77 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIDMapNilIsIdentity(t *testing.T) {
+	var m *IDMap
+	host, err := m.ToHost(1000)
+	if err != nil || host != 1000 {
+		t.Errorf("ToHost(1000) = %v, %v, want 1000, nil", host, err)
+	}
+	if c := m.ToContainer(1000); c != 1000 {
+		t.Errorf("ToContainer(1000) = %v, want 1000", c)
+	}
+}
+
+func TestIDMapRangeLookup(t *testing.T) {
+	m := NewIDMap([]IDRange{{ContainerID: 0, HostID: 100000, Length: 10}}, UnmappedIDReject)
+
+	host, err := m.ToHost(5)
+	if err != nil || host != 100005 {
+		t.Errorf("ToHost(5) = %v, %v, want 100005, nil", host, err)
+	}
+	if c := m.ToContainer(100005); c != 5 {
+		t.Errorf("ToContainer(100005) = %v, want 5", c)
+	}
+
+	// One past the end of the range is unmapped.
+	if _, err := m.ToHost(10); err != unix.EINVAL {
+		t.Errorf("ToHost(10) err = %v, want EINVAL", err)
+	}
+}
+
+func TestIDMapUnmappedPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   UnmappedIDPolicy
+		wantHost uint32
+		wantErr  error
+	}{
+		{"reject", UnmappedIDReject, 0, unix.EINVAL},
+		{"squash", UnmappedIDSquash, nobody, nil},
+		{"passthrough", UnmappedIDPassthrough, 42, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewIDMap(nil, tc.policy)
+			host, err := m.ToHost(42)
+			if err != tc.wantErr || host != tc.wantHost {
+				t.Errorf("ToHost(42) = %v, %v, want %v, %v", host, err, tc.wantHost, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIDMapToContainerSquash(t *testing.T) {
+	m := NewIDMap([]IDRange{{ContainerID: 0, HostID: 100000, Length: 10}}, UnmappedIDSquash)
+	if c := m.ToContainer(999999); c != nobody {
+		t.Errorf("ToContainer(999999) = %v, want %v (nobody)", c, nobody)
+	}
+}